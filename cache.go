@@ -0,0 +1,82 @@
+// Package freecache implements an in-memory, zero-GC-pressure cache.
+// Cache and segment here are the foundation everything else in the
+// package builds on: persist.go adds snapshotting, cache_mmap.go swaps
+// the backing RingBuf for an mmap'd one, stream.go adds streaming
+// Set/Get for large values, and eviction.go adds pluggable admission
+// policies on top of segment.evacuate.
+package freecache
+
+import "sync"
+
+const segmentCount = 256
+
+// minSegmentSize is the smallest a single segment's ring buffer is
+// allowed to shrink to; NewCache rounds a smaller requested size up to
+// minSegmentSize*segmentCount.
+const minSegmentSize = 512 * 1024
+
+// Cache is a thread-safe, in-memory cache with a fixed total capacity
+// split evenly across 256 segments, each guarded by its own lock so
+// concurrent access to different segments doesn't contend.
+type Cache struct {
+	locks    [segmentCount]sync.Mutex
+	segments [segmentCount]segment
+}
+
+// NewCache creates a cache with the given total size in bytes, split
+// evenly across 256 segments; size is rounded up to
+// minSegmentSize*256 if it's smaller. Any CacheOptions (e.g.
+// WithEvictionPolicy) are applied once every segment has been built.
+func NewCache(size int, opts ...CacheOption) *Cache {
+	if size < minSegmentSize*segmentCount {
+		size = minSegmentSize * segmentCount
+	}
+	cache := new(Cache)
+	segSize := size / segmentCount
+	for i := range cache.segments {
+		cache.segments[i] = newSegment(NewRingBuf(segSize, 0), i)
+	}
+	for _, opt := range opts {
+		opt(cache)
+	}
+	return cache
+}
+
+// Set inserts or overwrites key's value, expiring after expireSeconds
+// (0 means it never expires).
+func (cache *Cache) Set(key, value []byte, expireSeconds int) error {
+	hashVal := hashFunc(key)
+	segID := hashVal & 255
+	cache.locks[segID].Lock()
+	defer cache.locks[segID].Unlock()
+	return cache.segments[segID].set(key, value, hashVal, expireSeconds)
+}
+
+// Get returns a copy of key's value, or ErrNotFound.
+func (cache *Cache) Get(key []byte) ([]byte, error) {
+	hashVal := hashFunc(key)
+	segID := hashVal & 255
+	cache.locks[segID].Lock()
+	defer cache.locks[segID].Unlock()
+	return cache.segments[segID].get(key, hashVal)
+}
+
+// Del removes key's entry, reporting whether it was present.
+func (cache *Cache) Del(key []byte) bool {
+	hashVal := hashFunc(key)
+	segID := hashVal & 255
+	cache.locks[segID].Lock()
+	defer cache.locks[segID].Unlock()
+	return cache.segments[segID].del(key, hashVal)
+}
+
+// EntryCount returns the number of entries currently in the cache.
+func (cache *Cache) EntryCount() int64 {
+	var total int64
+	for i := range cache.segments {
+		cache.locks[i].Lock()
+		total += cache.segments[i].entryCount
+		cache.locks[i].Unlock()
+	}
+	return total
+}
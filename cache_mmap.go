@@ -0,0 +1,46 @@
+package freecache
+
+import "fmt"
+
+// NewCacheMMap creates a cache whose segments are backed by memory-mapped
+// files under dir instead of the Go heap (see NewRingBufMMap), so the
+// cached data lives outside GC scan range and, mapped MAP_SHARED, its
+// bytes stay in the files after a crash or restart. The returned cache
+// always starts empty: entries written to the same dir by an earlier
+// cache are not read back. Each segment gets its own file, named segment-<n>,
+// inside dir; dir must already exist. Call Cache.Sync to control when
+// dirty pages are flushed to disk rather than relying on the OS's own
+// writeback timing. Any CacheOptions (e.g. WithEvictionPolicy) are
+// applied once every segment has been mapped.
+func NewCacheMMap(dir string, size int, opts ...CacheOption) (cache *Cache, err error) {
+	if size < minSegmentSize*segmentCount {
+		size = minSegmentSize * segmentCount
+	}
+	cache = new(Cache)
+	segSize := size / len(cache.segments)
+	for i := range cache.segments {
+		rb, err := NewRingBufMMap(fmt.Sprintf("%s/segment-%d", dir, i), segSize, 0)
+		if err != nil {
+			return nil, fmt.Errorf("freecache: mmap segment %d: %w", i, err)
+		}
+		cache.segments[i] = newSegment(rb, i)
+	}
+	for _, opt := range opts {
+		opt(cache)
+	}
+	return cache, nil
+}
+
+// Sync flushes dirty pages for every mmap'd segment to disk. It is a
+// no-op for segments created with NewCache.
+func (cache *Cache) Sync() error {
+	for i := range cache.segments {
+		cache.locks[i].Lock()
+		err := cache.segments[i].rb.Sync()
+		cache.locks[i].Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package freecache
+
+import "testing"
+
+// TestNewCacheMMapSizeFloorMatchesNewCache guards against NewCacheMMap
+// diverging from NewCache's per-segment floor: both take a total size
+// and must round it up to at least minSegmentSize per segment, not
+// minSegmentSize for the whole cache.
+func TestNewCacheMMapSizeFloorMatchesNewCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewCacheMMap(dir, 1)
+	if err != nil {
+		t.Fatalf("NewCacheMMap: %v", err)
+	}
+	defer func() {
+		for i := range cache.segments {
+			cache.segments[i].rb.Close()
+		}
+	}()
+
+	got := cache.segments[0].rb.Size()
+	if got != int64(minSegmentSize) {
+		t.Fatalf("segment size = %d, want %d (minSegmentSize)", got, minSegmentSize)
+	}
+
+	key := make([]byte, 0)
+	value := make([]byte, minSegmentSize/2)
+	if err := cache.Set(key, value, 0); err != nil {
+		t.Fatalf("Set a half-segment value: %v", err)
+	}
+}
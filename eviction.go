@@ -0,0 +1,326 @@
+package freecache
+
+import "sync"
+
+// EvictionPolicy decides, at the segment level, whether an incoming Set
+// should be admitted, so a segment's replacement strategy can be swapped
+// without touching RingBuf's own overwrite-the-oldest behavior. It's
+// consulted from segment.evacuate (called by both set and
+// reserveForStream) and segment.get rather than RingBuf itself so each
+// segment keeps its own independent policy state, preserving the
+// existing sharded-lock design.
+//
+// hashVal and victimHash are always a key's 16-bit hash16 fingerprint
+// (widened to uint64), not its full hash, since that's all an entryPtr
+// keeps once it's written -- a policy's notion of "identity" is only as
+// precise as that fingerprint, so collisions across different keys that
+// share a hash16 are expected to occasionally skew Admit/OnHit.
+type EvictionPolicy interface {
+	// Admit is called before the ring buffer would overwrite the entry
+	// at victimHash to make room for hashVal; it reports whether the
+	// write should proceed. segment.evacuate calls it once per live
+	// victim it walks past and not at all while the ring still has free
+	// space; TinyLFUPolicy treats a victimHash of 0 as "no overwrite
+	// candidate" and always admits it.
+	Admit(hashVal, victimHash uint64) bool
+	// OnHit is called after a successful Get for hashVal.
+	OnHit(hashVal uint64)
+	// Rejections returns how many Admit calls this policy has refused,
+	// so callers can tune sketch/doorkeeper/protected-set sizing.
+	Rejections() int64
+}
+
+// RingPolicy is the default EvictionPolicy: it defers entirely to the
+// ring buffer's own overwrite-the-oldest behavior and never refuses
+// admission, matching freecache's existing near-LRU behavior.
+type RingPolicy struct{}
+
+func (RingPolicy) Admit(hashVal, victimHash uint64) bool { return true }
+func (RingPolicy) OnHit(hashVal uint64)                  {}
+func (RingPolicy) Rejections() int64                     { return 0 }
+
+// SLRUPolicy implements a segmented LRU: a small "protected" set of hot
+// hashes that Protected reports true for, so segment.get can re-Evacuate
+// them on every hit and keep pushing them past the less popular entries
+// the ring would otherwise overwrite next.
+type SLRUPolicy struct {
+	mu        sync.Mutex
+	capacity  int
+	protected map[uint64]struct{}
+	order     []uint64 // FIFO of protected hashes, oldest first
+}
+
+// NewSLRUPolicy returns an SLRUPolicy whose protected set holds up to
+// capacity hashes.
+func NewSLRUPolicy(capacity int) *SLRUPolicy {
+	return &SLRUPolicy{capacity: capacity, protected: make(map[uint64]struct{}, capacity)}
+}
+
+func (p *SLRUPolicy) Admit(hashVal, victimHash uint64) bool { return true }
+
+func (p *SLRUPolicy) OnHit(hashVal uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.protected[hashVal]; ok {
+		return
+	}
+	if len(p.order) >= p.capacity {
+		oldest := p.order[0]
+		p.order = p.order[1:]
+		delete(p.protected, oldest)
+	}
+	p.protected[hashVal] = struct{}{}
+	p.order = append(p.order, hashVal)
+}
+
+func (p *SLRUPolicy) Rejections() int64 { return 0 }
+
+// Protected reports whether hashVal is in the protected set, i.e.
+// whether this hit should re-Evacuate the entry to keep it ahead of the
+// ring's overwrite point.
+func (p *SLRUPolicy) Protected(hashVal uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.protected[hashVal]
+	return ok
+}
+
+// TinyLFUPolicy is a frequency-based admission filter: Admit compares
+// the incoming key's estimated frequency, from a 4-bit count-min
+// sketch, against the frequency of the entry the ring is about to
+// overwrite, and refuses admission when the incoming key is the less
+// frequent of the two. A doorkeeper bloom filter absorbs one-hit-wonders
+// so the sketch only tracks keys seen at least twice. This mirrors the
+// admission policy used by Caffeine/Ristretto and is a real hit-ratio
+// win over pure recency for skewed workloads.
+type TinyLFUPolicy struct {
+	mu         sync.Mutex
+	sketch     *countMinSketch
+	doorkeeper *bloomFilter
+	inserts    int64
+	agePeriod  int64
+	rejections int64
+}
+
+// NewTinyLFUPolicy returns a TinyLFUPolicy sized for roughly
+// sketchWidth distinct keys, sized as a small constant fraction of a
+// segment's expected entry count by the caller.
+func NewTinyLFUPolicy(sketchWidth int) *TinyLFUPolicy {
+	return &TinyLFUPolicy{
+		sketch:     newCountMinSketch(sketchWidth),
+		doorkeeper: newBloomFilter(sketchWidth * 8),
+		agePeriod:  int64(sketchWidth) * 10,
+	}
+}
+
+func (p *TinyLFUPolicy) OnHit(hashVal uint64) {
+	p.mu.Lock()
+	p.recordLocked(hashVal)
+	p.mu.Unlock()
+}
+
+func (p *TinyLFUPolicy) Admit(hashVal, victimHash uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.recordLocked(hashVal)
+	if victimHash == 0 {
+		return true
+	}
+	if p.sketch.estimate(hashVal) < p.sketch.estimate(victimHash) {
+		p.rejections++
+		return false
+	}
+	return true
+}
+
+func (p *TinyLFUPolicy) recordLocked(hashVal uint64) {
+	if !p.doorkeeper.testAndSet(hashVal) {
+		return
+	}
+	p.sketch.increment(hashVal)
+	p.inserts++
+	if p.inserts >= p.agePeriod {
+		p.sketch.age()
+		p.doorkeeper.reset()
+		p.inserts = 0
+	}
+}
+
+func (p *TinyLFUPolicy) Rejections() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rejections
+}
+
+// countMinSketch is a 4-bit count-min sketch: counters are packed two
+// per byte so the structure can be sized as a small fraction of a
+// segment's capacity despite being held per-segment rather than shared.
+type countMinSketch struct {
+	counters []byte // 4-bit counters, two per byte
+	mask     uint64
+}
+
+const cmsDepth = 4
+
+func newCountMinSketch(width int) *countMinSketch {
+	size := nextPow2(width)
+	return &countMinSketch{
+		counters: make([]byte, size/2),
+		mask:     uint64(size - 1),
+	}
+}
+
+func (s *countMinSketch) indexes(hashVal uint64) [cmsDepth]uint64 {
+	var idx [cmsDepth]uint64
+	h := hashVal
+	for i := 0; i < cmsDepth; i++ {
+		h = h*0x9E3779B97F4A7C15 + uint64(i)
+		idx[i] = h & s.mask
+	}
+	return idx
+}
+
+func (s *countMinSketch) get(i uint64) byte {
+	b := s.counters[i/2]
+	if i%2 == 0 {
+		return b & 0x0F
+	}
+	return b >> 4
+}
+
+func (s *countMinSketch) set(i uint64, v byte) {
+	b := s.counters[i/2]
+	if i%2 == 0 {
+		s.counters[i/2] = (b & 0xF0) | (v & 0x0F)
+	} else {
+		s.counters[i/2] = (b & 0x0F) | (v << 4)
+	}
+}
+
+func (s *countMinSketch) increment(hashVal uint64) {
+	for _, i := range s.indexes(hashVal) {
+		if v := s.get(i); v < 15 {
+			s.set(i, v+1)
+		}
+	}
+}
+
+func (s *countMinSketch) estimate(hashVal uint64) byte {
+	min := byte(15)
+	for _, i := range s.indexes(hashVal) {
+		if v := s.get(i); v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// age halves every counter. Called every agePeriod inserts so the
+// sketch tracks recent frequency rather than all-time frequency.
+func (s *countMinSketch) age() {
+	for i, b := range s.counters {
+		lo := (b & 0x0F) >> 1
+		hi := (b >> 4) >> 1
+		s.counters[i] = lo | (hi << 4)
+	}
+}
+
+// bloomFilter is the TinyLFU doorkeeper: a plain bit-set that lets
+// recordLocked skip incrementing the sketch for a key's first sighting.
+type bloomFilter struct {
+	bits []uint64
+	mask uint64
+}
+
+const bfHashes = 3
+
+func newBloomFilter(bits int) *bloomFilter {
+	size := nextPow2(bits)
+	return &bloomFilter{
+		bits: make([]uint64, size/64+1),
+		mask: uint64(size - 1),
+	}
+}
+
+func (f *bloomFilter) positions(hashVal uint64) [bfHashes]uint64 {
+	var pos [bfHashes]uint64
+	h := hashVal
+	for i := 0; i < bfHashes; i++ {
+		h = h*0xBF58476D1CE4E5B9 + uint64(i)
+		pos[i] = h & f.mask
+	}
+	return pos
+}
+
+// testAndSet reports whether hashVal had already been marked seen, and
+// marks it seen either way.
+func (f *bloomFilter) testAndSet(hashVal uint64) bool {
+	seen := true
+	for _, p := range f.positions(hashVal) {
+		word, bit := p/64, p%64
+		if f.bits[word]&(1<<bit) == 0 {
+			seen = false
+			f.bits[word] |= 1 << bit
+		}
+	}
+	return seen
+}
+
+func (f *bloomFilter) reset() {
+	for i := range f.bits {
+		f.bits[i] = 0
+	}
+}
+
+func nextPow2(n int) int {
+	p := 1
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// protectedChecker is implemented by EvictionPolicy values (e.g.
+// SLRUPolicy) whose hits should re-Evacuate the entry to the back of
+// the ring rather than leave it where OnHit found it. segment.get
+// type-asserts for it after calling OnHit.
+type protectedChecker interface {
+	Protected(hashVal uint64) bool
+}
+
+// CacheOption configures optional behavior on a Cache at construction
+// time, e.g. NewCache(size, WithEvictionPolicy(...)). NewCache and
+// NewCacheMMap apply their variadic opts once every segment has been
+// constructed.
+type CacheOption func(cache *Cache)
+
+// WithEvictionPolicy returns a CacheOption that installs newPolicy() as
+// every segment's EvictionPolicy in place of the default RingPolicy.
+// newPolicy is called once per segment so sketch/doorkeeper/protected-set
+// state stays sharded the same way segment locks already are.
+func WithEvictionPolicy(newPolicy func() EvictionPolicy) CacheOption {
+	return func(cache *Cache) {
+		for i := range cache.segments {
+			cache.segments[i].policy = newPolicy()
+		}
+	}
+}
+
+// policyFor returns seg's EvictionPolicy, defaulting to RingPolicy if
+// none was installed via WithEvictionPolicy.
+func policyFor(seg *segment) EvictionPolicy {
+	return seg.policyOrDefault()
+}
+
+// AdmissionRejections returns the total number of Set calls refused
+// admission across every segment by an admission-capable EvictionPolicy
+// (e.g. TinyLFUPolicy), for tuning sketch/doorkeeper sizing.
+func (cache *Cache) AdmissionRejections() int64 {
+	var total int64
+	for i := range cache.segments {
+		cache.locks[i].Lock()
+		total += policyFor(&cache.segments[i]).Rejections()
+		cache.locks[i].Unlock()
+	}
+	return total
+}
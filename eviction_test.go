@@ -0,0 +1,214 @@
+package freecache
+
+import "testing"
+
+// TestCountMinSketchEstimate guards the basic increment/estimate
+// contract: a hash incremented more times should never estimate lower
+// than one incremented fewer times, and an untouched hash starts at 0.
+func TestCountMinSketchEstimate(t *testing.T) {
+	s := newCountMinSketch(256)
+	hot := uint64(42)
+	cold := uint64(43)
+
+	if got := s.estimate(hot); got != 0 {
+		t.Fatalf("estimate before any increment: got %d, want 0", got)
+	}
+
+	for i := 0; i < 5; i++ {
+		s.increment(hot)
+	}
+	s.increment(cold)
+
+	if got := s.estimate(hot); got < 5 {
+		t.Fatalf("estimate(hot) after 5 increments: got %d, want >= 5", got)
+	}
+	if got := s.estimate(cold); got < 1 {
+		t.Fatalf("estimate(cold) after 1 increment: got %d, want >= 1", got)
+	}
+	if s.estimate(hot) <= s.estimate(cold) {
+		t.Fatalf("estimate(hot)=%d should exceed estimate(cold)=%d", s.estimate(hot), s.estimate(cold))
+	}
+}
+
+// TestCountMinSketchSaturates guards the 4-bit counter's ceiling: it
+// must never wrap past 15 no matter how many times it's incremented,
+// since set packs two counters per byte.
+func TestCountMinSketchSaturates(t *testing.T) {
+	s := newCountMinSketch(64)
+	hashVal := uint64(7)
+	for i := 0; i < 100; i++ {
+		s.increment(hashVal)
+	}
+	if got := s.estimate(hashVal); got != 15 {
+		t.Fatalf("estimate after 100 increments: got %d, want 15 (saturated)", got)
+	}
+}
+
+// TestCountMinSketchAge guards age's halving behavior, which is what
+// lets the sketch track recent frequency instead of all-time frequency.
+func TestCountMinSketchAge(t *testing.T) {
+	s := newCountMinSketch(64)
+	hashVal := uint64(11)
+	for i := 0; i < 8; i++ {
+		s.increment(hashVal)
+	}
+	before := s.estimate(hashVal)
+	s.age()
+	after := s.estimate(hashVal)
+	if after >= before {
+		t.Fatalf("estimate after age: got %d, want < %d (before)", after, before)
+	}
+	if after != before/2 {
+		t.Fatalf("estimate after age: got %d, want %d (before/2)", after, before/2)
+	}
+}
+
+// TestBloomFilterTestAndSet guards the doorkeeper's one-hit-wonder
+// absorption: a hash's first testAndSet must report unseen, and every
+// subsequent call for the same hash must report seen, until reset.
+func TestBloomFilterTestAndSet(t *testing.T) {
+	f := newBloomFilter(1024)
+	hashVal := uint64(99)
+
+	if f.testAndSet(hashVal) {
+		t.Fatal("first testAndSet: got seen, want unseen")
+	}
+	if !f.testAndSet(hashVal) {
+		t.Fatal("second testAndSet: got unseen, want seen")
+	}
+
+	f.reset()
+	if f.testAndSet(hashVal) {
+		t.Fatal("testAndSet after reset: got seen, want unseen")
+	}
+}
+
+// TestTinyLFUPolicyDoorkeeperAbsorbsFirstSighting guards that
+// recordLocked, reached here through OnHit (Admit shares it), doesn't
+// increment the sketch for a key's first
+// sighting, only from its second sighting onward -- that's what lets a
+// scan of one-hit-wonders avoid polluting the sketch.
+func TestTinyLFUPolicyDoorkeeperAbsorbsFirstSighting(t *testing.T) {
+	p := NewTinyLFUPolicy(256)
+	hashVal := uint64(5)
+
+	p.OnHit(hashVal)
+	if got := p.sketch.estimate(hashVal); got != 0 {
+		t.Fatalf("sketch estimate after first sighting: got %d, want 0", got)
+	}
+
+	p.OnHit(hashVal)
+	if got := p.sketch.estimate(hashVal); got == 0 {
+		t.Fatal("sketch estimate after second sighting: got 0, want > 0")
+	}
+}
+
+// TestTinyLFUPolicyAdmitRefusesLessFrequentIncomer guards the core
+// admission decision: once a victim is strictly more frequent than the
+// incoming key, Admit must refuse and count the rejection; a victimHash
+// of 0 (no overwrite candidate) must always be admitted regardless.
+func TestTinyLFUPolicyAdmitRefusesLessFrequentIncomer(t *testing.T) {
+	p := NewTinyLFUPolicy(256)
+	hot := uint64(1)
+	cold := uint64(2)
+
+	// Prime the doorkeeper and sketch for both keys, then push hot's
+	// frequency well above cold's.
+	for i := 0; i < 10; i++ {
+		p.OnHit(hot)
+	}
+	p.OnHit(cold)
+	p.OnHit(cold)
+
+	if !p.Admit(hot, 0) {
+		t.Fatal("Admit with victimHash 0: got refused, want admitted")
+	}
+	if p.Admit(cold, hot) {
+		t.Fatal("Admit(cold, hot): got admitted, want refused (cold is less frequent)")
+	}
+	if got := p.Rejections(); got != 1 {
+		t.Fatalf("Rejections: got %d, want 1", got)
+	}
+	if !p.Admit(hot, cold) {
+		t.Fatal("Admit(hot, cold): got refused, want admitted (hot is more frequent)")
+	}
+}
+
+// TestSLRUPolicyPromotesOnHitWithFIFOEviction guards OnHit's protected-set
+// bookkeeping: a hash is promoted into the protected set on its first
+// hit, stays protected on later hits, and once the set is at capacity,
+// promoting a new hash evicts the oldest protected one.
+func TestSLRUPolicyPromotesOnHitWithFIFOEviction(t *testing.T) {
+	p := NewSLRUPolicy(2)
+
+	p.OnHit(1)
+	if !p.Protected(1) {
+		t.Fatal("Protected(1) after first OnHit: got false, want true")
+	}
+
+	p.OnHit(2)
+	if !p.Protected(1) || !p.Protected(2) {
+		t.Fatal("Protected(1) and Protected(2): want both true at capacity 2")
+	}
+
+	// A third distinct hash exceeds capacity, evicting 1 (the oldest).
+	p.OnHit(3)
+	if p.Protected(1) {
+		t.Fatal("Protected(1) after capacity eviction: got true, want false")
+	}
+	if !p.Protected(2) || !p.Protected(3) {
+		t.Fatal("Protected(2) and Protected(3): want both true after evicting 1")
+	}
+
+	// Admit always defers to the ring; SLRU only ever shapes who gets
+	// re-Evacuated on hit, never who gets refused outright.
+	if !p.Admit(1, 2) {
+		t.Fatal("SLRUPolicy.Admit: got refused, want always admitted")
+	}
+}
+
+// TestSegmentGetReEvacuatesProtectedEntry guards the segment.get wiring
+// (see protectedChecker): a hit on a key the policy reports Protected
+// for should move the entry ahead of the ring's overwrite point via
+// RingBuf.Evacuate, instead of leaving it where a subsequent Set could
+// evict it despite being the segment's hottest key.
+func TestSegmentGetReEvacuatesProtectedEntry(t *testing.T) {
+	seg := newSegment(NewRingBuf(4096, 0), 0)
+	seg.policy = NewSLRUPolicy(10)
+
+	key := []byte("hot")
+	hashVal := hashFunc(key)
+	if err := seg.set(key, []byte("value"), hashVal, 0); err != nil {
+		t.Fatalf("set: %v", err)
+	}
+
+	slotId := uint8(hashVal)
+	hash16 := uint16(hashVal)
+	slot := seg.getSlot(slotId)
+	idx, ok := seg.lookup(slot, hash16, key)
+	if !ok {
+		t.Fatal("lookup: entry not found right after set")
+	}
+	before := slot[idx].offset
+
+	if _, err := seg.get(key, hashVal); err != nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	slot = seg.getSlot(slotId)
+	idx, ok = seg.lookup(slot, hash16, key)
+	if !ok {
+		t.Fatal("lookup: entry not found after get")
+	}
+	if slot[idx].offset == before {
+		t.Fatal("offset unchanged after a protected hit: want it re-Evacuated forward")
+	}
+
+	got, err := seg.get(key, hashVal)
+	if err != nil {
+		t.Fatalf("get after re-Evacuate: %v", err)
+	}
+	if string(got) != "value" {
+		t.Fatalf("get after re-Evacuate: got %q, want %q", got, "value")
+	}
+}
@@ -1,15 +1,39 @@
 package freecache
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
 	"unsafe"
 )
 
+// ErrInvalidCursor is returned by NewIteratorFromCursor when the token is
+// malformed or was not produced by Iterator.Cursor.
+var ErrInvalidCursor = errors.New("freecache: invalid cursor")
+
+// ErrCursorStale is returned by NewIteratorFromCursor when the segment
+// the cursor points into has changed entry count since the cursor was
+// taken, so resuming from it could skip or repeat entries.
+var ErrCursorStale = errors.New("freecache: cursor is stale")
+
+const cursorMagic uint32 = 0x43555253 // "CURS"
+
 // Iterator iterates the entries for the cache.
 type Iterator struct {
 	cache      *Cache
 	segmentIdx int
 	slotIdx    int
 	entryIdx   int
+
+	// lastSeg/lastValOff/lastValLen describe the value span of the most
+	// recent entry handed out by nextForSlot, so EntryReader can stream
+	// it without requiring nextForSlot to have allocated it up front.
+	// setCurrent keeps this span pinned (see pinStream) for as long as
+	// it's current.
+	lastSeg    *segment
+	lastValOff int64
+	lastValLen int64
 }
 
 // Entry represents a key/value pair.
@@ -68,6 +92,12 @@ func (it *Iterator) nextForSlot(seg *segment, slotId int) *Entry {
 		hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
 		// 未设置过期时间或者该entry还未过期
 		if hdr.expireAt == 0 || hdr.expireAt > now {
+			valOff := ptr.offset + ENTRY_HDR_SIZE + int64(hdr.keyLen)
+			if isPending(seg, valOff) {
+				// A SetStream writer is still filling this entry in;
+				// its value bytes aren't complete yet.
+				continue
+			}
 			entry := new(Entry)
 			entry.Key = make([]byte, hdr.keyLen)
 			entry.Value = make([]byte, hdr.valLen)
@@ -75,16 +105,227 @@ func (it *Iterator) nextForSlot(seg *segment, slotId int) *Entry {
 			// 读key
 			seg.rb.ReadAt(entry.Key, ptr.offset+ENTRY_HDR_SIZE)
 			// 读value
-			seg.rb.ReadAt(entry.Value, ptr.offset+ENTRY_HDR_SIZE+int64(hdr.keyLen))
+			seg.rb.ReadAt(entry.Value, valOff)
+			it.setCurrent(seg, valOff, int64(hdr.valLen))
 			return entry
 		}
 	}
 	return nil
 }
 
+// setCurrent records the value span of the entry nextForSlot just read
+// as the iterator's current entry for EntryReader, pinning it against
+// eviction (see pinStream) while the segment's lock is still held here
+// -- pinning lazily inside EntryReader itself would be too late, since a
+// concurrent evacuate could already have reclaimed the span by the time
+// EntryReader is called. It releases the pin on whatever entry was
+// previously current, since that protection only needs to last until
+// the next Next()/NextBatch() call.
+func (it *Iterator) setCurrent(seg *segment, valOff, valLen int64) {
+	if it.lastSeg != nil {
+		unpinStream(it.lastSeg, it.lastValOff)
+	}
+	pinStream(seg, valOff)
+	it.lastSeg = seg
+	it.lastValOff = valOff
+	it.lastValLen = valLen
+}
+
 // NewIterator creates a new iterator for the cache.
 func (cache *Cache) NewIterator() *Iterator {
 	return &Iterator{
 		cache: cache,
 	}
 }
+
+// NextBatch returns up to n entries, acquiring each segment's lock once
+// for the whole batch instead of once per entry as Next does. This is
+// the fast path for a full scan: a background export or replication job
+// can pull large batches without holding a segment lock per entry or
+// losing its place if the process restarts (see Cursor).
+func (it *Iterator) NextBatch(n int) ([]Entry, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	entries := make([]Entry, 0, n)
+	for it.segmentIdx < 256 && len(entries) < n {
+		it.collectForSegment(it.segmentIdx, n, &entries)
+		if len(entries) >= n {
+			break
+		}
+		it.segmentIdx++
+		it.slotIdx = 0
+		it.entryIdx = 0
+	}
+	return entries, nil
+}
+
+// collectForSegment appends entries from segIdx to entries until either
+// n entries total have been collected or the segment is exhausted.
+func (it *Iterator) collectForSegment(segIdx int, n int, entries *[]Entry) {
+	it.cache.locks[segIdx].Lock()
+	defer it.cache.locks[segIdx].Unlock()
+	seg := &it.cache.segments[segIdx]
+	for it.slotIdx < 256 && len(*entries) < n {
+		entry := it.nextForSlot(seg, it.slotIdx)
+		if entry != nil {
+			*entries = append(*entries, *entry)
+			continue
+		}
+		it.slotIdx++
+		it.entryIdx = 0
+	}
+}
+
+// Cursor returns an opaque token encoding the iterator's current
+// position (segment, slot, entry) plus the current segment's entry
+// count and ring end offset for staleness detection. The token can be
+// persisted and later passed to Cache.NewIteratorFromCursor to resume
+// iteration, including across process restarts, without starting the
+// scan over.
+//
+// entryCount alone misses one case: a Set that overwrites an existing
+// key leaves entryCount unchanged but still moves the ring's write
+// offset, relocating slots below it. Capturing rb.End() alongside
+// entryCount catches that case too; it's still not a complete guarantee
+// against every reordering (e.g. a del followed by a set of a different
+// key can leave both values unchanged), so a resumed scan should be
+// treated as best-effort, not exact, under concurrent writes.
+func (it *Iterator) Cursor() ([]byte, error) {
+	it.cache.locks[it.segmentIdx].Lock()
+	entryCount := it.cache.segments[it.segmentIdx].entryCount
+	rbEnd := it.cache.segments[it.segmentIdx].rb.End()
+	it.cache.locks[it.segmentIdx].Unlock()
+
+	buf := new(bytes.Buffer)
+	if err := writeUint32(buf, cursorMagic); err != nil {
+		return nil, err
+	}
+	if err := writeInt32(buf, int32(it.segmentIdx)); err != nil {
+		return nil, err
+	}
+	if err := writeInt32(buf, int32(it.slotIdx)); err != nil {
+		return nil, err
+	}
+	if err := writeInt32(buf, int32(it.entryIdx)); err != nil {
+		return nil, err
+	}
+	if err := writeInt64(buf, entryCount); err != nil {
+		return nil, err
+	}
+	if err := writeInt64(buf, rbEnd); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewIteratorFromCursor creates an iterator that resumes from a token
+// previously returned by Iterator.Cursor. It returns ErrCursorStale if
+// the target segment's entry count or ring end offset has changed since
+// the cursor was taken, since the slot/entry offsets it encodes would
+// no longer line up with the segment's current contents.
+func (cache *Cache) NewIteratorFromCursor(tok []byte) (*Iterator, error) {
+	r := bytes.NewReader(tok)
+	magic, err := readUint32(r)
+	if err != nil || magic != cursorMagic {
+		return nil, ErrInvalidCursor
+	}
+	segmentIdx, err := readInt32(r)
+	if err != nil || segmentIdx < 0 || int(segmentIdx) >= len(cache.segments) {
+		return nil, ErrInvalidCursor
+	}
+	slotIdx, err := readInt32(r)
+	if err != nil || slotIdx < 0 {
+		return nil, ErrInvalidCursor
+	}
+	entryIdx, err := readInt32(r)
+	if err != nil || entryIdx < 0 {
+		return nil, ErrInvalidCursor
+	}
+	entryCount, err := readInt64(r)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	rbEnd, err := readInt64(r)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	cache.locks[segmentIdx].Lock()
+	currentCount := cache.segments[segmentIdx].entryCount
+	currentEnd := cache.segments[segmentIdx].rb.End()
+	cache.locks[segmentIdx].Unlock()
+	if currentCount != entryCount || currentEnd != rbEnd {
+		return nil, ErrCursorStale
+	}
+
+	return &Iterator{
+		cache:      cache,
+		segmentIdx: int(segmentIdx),
+		slotIdx:    int(slotIdx),
+		entryIdx:   int(entryIdx),
+	}, nil
+}
+
+// ErrNoCurrentEntry is returned by EntryReader when it is called before
+// Next or NextBatch has returned an entry.
+var ErrNoCurrentEntry = errors.New("freecache: no current entry")
+
+// entryValueReader is the io.ReadCloser returned by Iterator.EntryReader.
+// Like getStreamReader, it falls back to a heap copy (see pinnedData) if
+// a concurrent evacuate reclaims the ring space under it before Close,
+// and for the same reason as getStreamReader, it takes lock for each
+// Read call rather than relying on the pin alone: until evacuate has
+// actually detached the reader onto a heap copy, Read walks seg.rb
+// directly, which a concurrent Set/evacuate on the same segment can be
+// mutating at the same time.
+type entryValueReader struct {
+	r    *RingBufReader
+	seg  *segment
+	lock *sync.Mutex
+	off  int64
+	read int64
+}
+
+func (er *entryValueReader) Read(p []byte) (int, error) {
+	er.lock.Lock()
+	defer er.lock.Unlock()
+	if buf := pinnedData(er.seg, er.off); buf != nil {
+		if er.read >= int64(len(buf)) {
+			return 0, io.EOF
+		}
+		n := copy(p, buf[er.read:])
+		er.read += int64(n)
+		return n, nil
+	}
+	n, err := er.r.Read(p)
+	er.read += int64(n)
+	return n, err
+}
+
+func (er *entryValueReader) Close() error {
+	unpinStream(er.seg, er.off)
+	return nil
+}
+
+// EntryReader returns a reader over the value of the entry most recently
+// returned by Next/NextBatch, without allocating a []byte for it the way
+// Entry.Value does. This is the streaming counterpart to nextForSlot's
+// eager read, useful for copying large values straight to a sink (e.g. a
+// replication target) instead of through Go heap memory. The entry's
+// ring span is pinned against eviction (the same mechanism GetStream
+// uses) from the moment Next/NextBatch returned it, so a concurrent
+// write to the segment can't leave the reader pointed at reclaimed or
+// reused bytes; the caller must Close the reader, and must do so before
+// the iterator advances past this entry.
+func (it *Iterator) EntryReader() (io.ReadCloser, error) {
+	if it.lastSeg == nil {
+		return nil, ErrNoCurrentEntry
+	}
+	return &entryValueReader{
+		r:    it.lastSeg.rb.ReaderAt(it.lastValOff, it.lastValLen),
+		seg:  it.lastSeg,
+		lock: &it.cache.locks[it.lastSeg.segId],
+		off:  it.lastValOff,
+	}, nil
+}
@@ -0,0 +1,278 @@
+package freecache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// On-disk snapshot format: a magic header and version, followed by the
+// segment count and then each segment written back to back. Segments are
+// streamed one at a time so SaveTo/LoadFrom never need more than a
+// single segment's worth of extra memory.
+const (
+	snapshotMagic uint32 = 0xF6EECACE
+	// snapshotVersion 2 added an explicit slotCap field per segment;
+	// version 1 snapshots can't be told apart from a segment whose slots
+	// never grew past their initial capacity, so LoadFrom rejects them.
+	snapshotVersion uint32 = 2
+)
+
+var (
+	// ErrSnapshotMagic is returned by LoadFrom when r does not start with
+	// the expected snapshot header.
+	ErrSnapshotMagic = errors.New("freecache: not a freecache snapshot")
+	// ErrSnapshotVersion is returned by LoadFrom when the snapshot was
+	// written by an incompatible version of this package.
+	ErrSnapshotVersion = errors.New("freecache: unsupported snapshot version")
+	// ErrSnapshotSize is returned by LoadFrom when the cache's segment
+	// count or a segment's capacity doesn't match the snapshot. Resize
+	// the destination cache's segments (see RingBuf.Resize) before
+	// retrying if you want to load into a differently sized cache.
+	ErrSnapshotSize = errors.New("freecache: snapshot size does not match cache layout")
+	// ErrSnapshotChecksum is returned by LoadFrom when a segment's stored
+	// CRC32C does not match its data, i.e. the snapshot is corrupted.
+	ErrSnapshotChecksum = errors.New("freecache: snapshot data corrupted (crc32c mismatch)")
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// snapshotTimer is implemented by Timer values that carry state which
+// needs to survive a save/restore cycle, e.g. a fake timer used in
+// tests to control the clock deterministically. The default Timer used
+// by NewCache is a thin wrapper over time.Now and has no state of its
+// own to save, so it doesn't implement this interface and saveTo/
+// loadFrom simply write/read a zero offset for it.
+type snapshotTimer interface {
+	Offset() uint32
+	SetOffset(uint32)
+}
+
+// SaveTo serializes the full state of the cache -- every segment's ring
+// buffer, slot index and entry count -- to w so it can be restored with
+// LoadFrom, letting a service warm-start instead of paying for a cold
+// cache after every restart.
+func (cache *Cache) SaveTo(w io.Writer) error {
+	if err := writeUint32(w, snapshotMagic); err != nil {
+		return err
+	}
+	if err := writeUint32(w, snapshotVersion); err != nil {
+		return err
+	}
+	if err := writeUint32(w, uint32(len(cache.segments))); err != nil {
+		return err
+	}
+	for i := range cache.segments {
+		cache.locks[i].Lock()
+		err := cache.segments[i].saveTo(w)
+		cache.locks[i].Unlock()
+		if err != nil {
+			return fmt.Errorf("freecache: save segment %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// LoadFrom restores a cache previously written by SaveTo. The receiver
+// must already be sized (e.g. via NewCache) to the same segment count
+// and per-segment capacity it was saved with; a mismatch is rejected
+// with ErrSnapshotSize rather than silently discarding data.
+func (cache *Cache) LoadFrom(r io.Reader) error {
+	magic, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+	if magic != snapshotMagic {
+		return ErrSnapshotMagic
+	}
+	version, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+	if version != snapshotVersion {
+		return ErrSnapshotVersion
+	}
+	segCount, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+	if int(segCount) != len(cache.segments) {
+		return ErrSnapshotSize
+	}
+	for i := range cache.segments {
+		cache.locks[i].Lock()
+		err := cache.segments[i].loadFrom(r)
+		cache.locks[i].Unlock()
+		if err != nil {
+			return fmt.Errorf("freecache: load segment %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (seg *segment) saveTo(w io.Writer) error {
+	begin := seg.rb.Begin()
+	capacity := seg.rb.Size()
+	dataLen := seg.rb.End() - begin
+	if err := writeInt64(w, begin); err != nil {
+		return err
+	}
+	if err := writeInt64(w, capacity); err != nil {
+		return err
+	}
+	if err := writeInt64(w, dataLen); err != nil {
+		return err
+	}
+	if err := writeInt64(w, seg.entryCount); err != nil {
+		return err
+	}
+	for _, slotLen := range seg.slotLens {
+		if err := writeInt32(w, slotLen); err != nil {
+			return err
+		}
+	}
+	if err := writeInt32(w, seg.slotCap); err != nil {
+		return err
+	}
+	if err := writeInt64(w, int64(len(seg.slotsData))); err != nil {
+		return err
+	}
+	for _, ptr := range seg.slotsData {
+		if err := writeInt64(w, ptr.offset); err != nil {
+			return err
+		}
+		if err := writeUint32(w, uint32(ptr.hash16)<<16|uint32(ptr.keyLen)); err != nil {
+			return err
+		}
+	}
+	var timerOffset uint32
+	if st, ok := seg.timer.(snapshotTimer); ok {
+		timerOffset = st.Offset()
+	}
+	if err := writeUint32(w, timerOffset); err != nil {
+		return err
+	}
+	crcw := crc32.New(crc32cTable)
+	if _, err := seg.rb.WriteTo(io.MultiWriter(w, crcw)); err != nil {
+		return err
+	}
+	return writeUint32(w, crcw.Sum32())
+}
+
+func (seg *segment) loadFrom(r io.Reader) error {
+	begin, err := readInt64(r)
+	if err != nil {
+		return err
+	}
+	capacity, err := readInt64(r)
+	if err != nil {
+		return err
+	}
+	if capacity != seg.rb.Size() {
+		return ErrSnapshotSize
+	}
+	dataLen, err := readInt64(r)
+	if err != nil {
+		return err
+	}
+	entryCount, err := readInt64(r)
+	if err != nil {
+		return err
+	}
+	var slotLens [256]int32
+	for i := range slotLens {
+		v, err := readInt32(r)
+		if err != nil {
+			return err
+		}
+		slotLens[i] = v
+	}
+	slotCap, err := readInt32(r)
+	if err != nil {
+		return err
+	}
+	slotDataLen, err := readInt64(r)
+	if err != nil {
+		return err
+	}
+	if slotCap <= 0 || int64(slotCap)*256 != slotDataLen {
+		return ErrSnapshotSize
+	}
+	slotsData := make([]entryPtr, slotDataLen)
+	for i := range slotsData {
+		off, err := readInt64(r)
+		if err != nil {
+			return err
+		}
+		packed, err := readUint32(r)
+		if err != nil {
+			return err
+		}
+		slotsData[i] = entryPtr{offset: off, hash16: uint16(packed >> 16), keyLen: uint16(packed)}
+	}
+	timerOffset, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+	seg.rb.Reset(begin)
+	crcr := crc32.New(crc32cTable)
+	if _, err := seg.rb.ReadFrom(io.TeeReader(io.LimitReader(r, dataLen), crcr)); err != nil {
+		return err
+	}
+	wantCRC, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+	if crcr.Sum32() != wantCRC {
+		return ErrSnapshotChecksum
+	}
+	seg.entryCount = entryCount
+	seg.slotLens = slotLens
+	seg.slotCap = slotCap
+	seg.slotsData = slotsData
+	if st, ok := seg.timer.(snapshotTimer); ok {
+		st.SetOffset(timerOffset)
+	}
+	return nil
+}
+
+func writeUint32(w io.Writer, v uint32) error {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	_, err := w.Write(buf[:])
+	return err
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf[:]), nil
+}
+
+func writeInt32(w io.Writer, v int32) error {
+	return writeUint32(w, uint32(v))
+}
+
+func readInt32(r io.Reader) (int32, error) {
+	v, err := readUint32(r)
+	return int32(v), err
+}
+
+func writeInt64(w io.Writer, v int64) error {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	_, err := w.Write(buf[:])
+	return err
+}
+
+func readInt64(r io.Reader) (int64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(buf[:])), nil
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 )
 
 var ErrOutOfRange = errors.New("out of range")
@@ -17,6 +18,7 @@ type RingBuf struct {
 	end   int64 // ending offset of the data stream.
 	data  []byte
 	index int // range from '0' to 'len(rb.data)-1'
+	file  *os.File // non-nil when data is a MAP_SHARED mapping of this file, see NewRingBufMMap
 }
 
 func NewRingBuf(size int, begin int64) (rb RingBuf) {
@@ -26,6 +28,54 @@ func NewRingBuf(size int, begin int64) (rb RingBuf) {
 	return
 }
 
+// NewRingBufMMap creates a RingBuf backed by a MAP_SHARED mapping of
+// path instead of a Go-allocated slice. The file is created if needed and
+// truncated or extended to exactly size bytes. Because the mapping lives
+// outside the Go heap it isn't scanned by the GC, and because MAP_SHARED
+// writes go straight to the page cache the written bytes stay in the file
+// after a process crash or restart -- Sync can be used to force dirty
+// pages to disk. The returned RingBuf is always Reset to begin, so bytes
+// already in the file are not part of its data stream. The
+// platform-specific mapping code lives behind build tags in ringbuf_mmap_unix.go / ringbuf_mmap_windows.go.
+func NewRingBufMMap(path string, size int, begin int64) (rb RingBuf, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return rb, err
+	}
+	data, err := mmapFile(f, size)
+	if err != nil {
+		f.Close()
+		return rb, err
+	}
+	rb.data = data
+	rb.file = f
+	rb.Reset(begin)
+	return rb, nil
+}
+
+// Sync flushes dirty pages of an mmap'd RingBuf to disk. It is a no-op
+// for heap-backed ring buffers created with NewRingBuf.
+func (rb *RingBuf) Sync() error {
+	if rb.file == nil {
+		return nil
+	}
+	return msyncData(rb.data)
+}
+
+// Close unmaps and closes the backing file of an mmap'd RingBuf. It is a
+// no-op for heap-backed ring buffers created with NewRingBuf.
+func (rb *RingBuf) Close() error {
+	if rb.file == nil {
+		return nil
+	}
+	err := munmapData(rb.data)
+	if cerr := rb.file.Close(); err == nil {
+		err = cerr
+	}
+	rb.file = nil
+	return err
+}
+
 // Reset the ring buffer
 //
 // Parameters:
@@ -252,6 +302,10 @@ func (rb *RingBuf) Resize(newSize int) {
 	if len(rb.data) == newSize {
 		return
 	}
+	if rb.file != nil {
+		rb.resizeMMap(newSize)
+		return
+	}
 	newData := make([]byte, newSize)
 	var offset int
 	// 满了
@@ -275,6 +329,145 @@ func (rb *RingBuf) Resize(newSize int) {
 	rb.index = 0
 }
 
+// resizeMMap grows or shrinks an mmap'd RingBuf's backing file and
+// remaps it, preserving the logical contents the same way the
+// heap-backed path above does.
+func (rb *RingBuf) resizeMMap(newSize int) {
+	var offset int
+	if rb.end-rb.begin == int64(len(rb.data)) {
+		offset = rb.index
+	}
+	if int(rb.end-rb.begin) > newSize {
+		discard := int(rb.end-rb.begin) - newSize
+		offset = (offset + discard) % len(rb.data)
+		rb.begin = rb.end - int64(newSize)
+	}
+	old := rb.data
+	staged := make([]byte, newSize)
+	n := copy(staged, old[offset:])
+	if n < newSize {
+		copy(staged[n:], old[:offset])
+	}
+	munmapData(old)
+	mapped, err := mmapFile(rb.file, newSize)
+	if err != nil {
+		// The file is already the right size on disk; fall back to the
+		// heap-staged copy rather than losing data, at the cost of this
+		// RingBuf no longer being mmap-backed until remapped.
+		rb.data = staged
+		rb.file = nil
+		rb.index = 0
+		return
+	}
+	copy(mapped, staged)
+	rb.data = mapped
+	rb.index = 0
+}
+
+// WriteTo writes the logical data stream (from begin to end) to w as a
+// contiguous sequence of bytes, unwrapping the ring so the writer sees
+// the bytes in stream order. It implements io.WriterTo. The begin/end/
+// index bookkeeping itself is not written; callers that need to restore
+// a RingBuf's absolute stream offsets must persist rb.Begin() alongside
+// the written bytes and Reset to it before calling ReadFrom.
+func (rb *RingBuf) WriteTo(w io.Writer) (n int64, err error) {
+	dataLen := int(rb.end - rb.begin)
+	if dataLen == 0 {
+		return 0, nil
+	}
+	readOff := rb.getDataOff(rb.begin)
+	readEnd := readOff + dataLen
+	if readEnd <= len(rb.data) {
+		wn, werr := w.Write(rb.data[readOff:readEnd])
+		return int64(wn), werr
+	}
+	wn, werr := w.Write(rb.data[readOff:])
+	n = int64(wn)
+	if werr != nil {
+		return n, werr
+	}
+	wn, werr = w.Write(rb.data[:readEnd-len(rb.data)])
+	n += int64(wn)
+	return n, werr
+}
+
+// ReadFrom reads from r until EOF, appending the bytes via Write so the
+// ring's begin/end/index are recomputed the same way they would be from
+// live traffic. It implements io.ReaderFrom. Callers that need the
+// restored data to land at a specific stream offset should call Reset
+// with that offset first.
+func (rb *RingBuf) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := make([]byte, 32*1024)
+	for {
+		rn, rerr := r.Read(buf)
+		if rn > 0 {
+			wn, werr := rb.Write(buf[:rn])
+			n += int64(wn)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+	return n, nil
+}
+
+// RingBufWriter implements io.Writer over [off, off+length) of a
+// RingBuf's stream. The range must already be reserved (i.e. off+length
+// <= rb.End()) -- it fills bytes within that range rather than growing
+// the ring itself, which is what lets Cache.SetStream reserve a value's
+// space once up front and then stream arbitrarily small writes into it.
+type RingBufWriter struct {
+	rb  *RingBuf
+	off int64
+	end int64
+}
+
+// WriterAt returns a RingBufWriter over [off, off+length) of the stream.
+func (rb *RingBuf) WriterAt(off int64, length int64) *RingBufWriter {
+	return &RingBufWriter{rb: rb, off: off, end: off + length}
+}
+
+func (w *RingBufWriter) Write(p []byte) (n int, err error) {
+	if w.off+int64(len(p)) > w.end {
+		return 0, ErrOutOfRange
+	}
+	n, err = w.rb.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// RingBufReader implements io.Reader over [off, off+length) of a
+// RingBuf's stream, for reading a value back out without materializing
+// it as a single []byte.
+type RingBufReader struct {
+	rb  *RingBuf
+	off int64
+	end int64
+}
+
+// ReaderAt returns a RingBufReader over [off, off+length) of the stream.
+func (rb *RingBuf) ReaderAt(off int64, length int64) *RingBufReader {
+	return &RingBufReader{rb: rb, off: off, end: off + length}
+}
+
+func (r *RingBufReader) Read(p []byte) (n int, err error) {
+	if r.off >= r.end {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.end-r.off {
+		p = p[:r.end-r.off]
+	}
+	n, err = r.rb.ReadAt(p, r.off)
+	r.off += int64(n)
+	return n, err
+}
+
 func (rb *RingBuf) Skip(length int64) {
 	rb.end += length
 	rb.index += int(length)
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package freecache
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmapFile maps size bytes of f into memory with MAP_SHARED so writes
+// are visible to every process mapping the file and persist in the
+// file after the process exits or crashes. f is first truncated or
+// extended to exactly size bytes.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	if err := f.Truncate(int64(size)); err != nil {
+		return nil, err
+	}
+	return unix.Mmap(int(f.Fd()), 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+}
+
+func munmapData(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return unix.Munmap(data)
+}
+
+func msyncData(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return unix.Msync(data, unix.MS_SYNC)
+}
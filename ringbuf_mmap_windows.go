@@ -0,0 +1,52 @@
+//go:build windows
+// +build windows
+
+package freecache
+
+import (
+	"os"
+	"reflect"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// mmapFile maps size bytes of f into memory via CreateFileMapping /
+// MapViewOfFile, the Windows equivalent of a MAP_SHARED unix mapping. f
+// is first truncated or extended to exactly size bytes.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	if err := f.Truncate(int64(size)); err != nil {
+		return nil, err
+	}
+	h, err := windows.CreateFileMapping(windows.Handle(f.Fd()), nil, windows.PAGE_READWRITE, 0, uint32(size), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(h)
+	addr, err := windows.MapViewOfFile(h, windows.FILE_MAP_WRITE, 0, 0, uintptr(size))
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	sh := (*reflect.SliceHeader)(unsafe.Pointer(&data))
+	sh.Data = addr
+	sh.Len = size
+	sh.Cap = size
+	return data, nil
+}
+
+func munmapData(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	addr := uintptr(unsafe.Pointer(&data[0]))
+	return windows.UnmapViewOfFile(addr)
+}
+
+func msyncData(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	addr := uintptr(unsafe.Pointer(&data[0]))
+	return windows.FlushViewOfFile(addr, uintptr(len(data)))
+}
@@ -0,0 +1,409 @@
+package freecache
+
+import (
+	"errors"
+	"time"
+	"unsafe"
+)
+
+const (
+	// slotCount is the number of slots a segment's index is split into;
+	// a key's low byte selects its slot the same way its low byte also
+	// selects the segment (see Cache.Set/Get/Del).
+	slotCount = 256
+	// maxKeyLength is the largest key Set will accept.
+	maxKeyLength = 65535
+	// ENTRY_HDR_SIZE is the on-disk size of entryHdr; it's a plain
+	// constant rather than unsafe.Sizeof so it can size byte arrays.
+	ENTRY_HDR_SIZE = 24
+)
+
+// ErrLargeKey is returned by Set when key is longer than maxKeyLength.
+var ErrLargeKey = errors.New("freecache: key is larger than 65535")
+
+// ErrLargeEntry is returned by Set when the entry (header, key and
+// value together) can't fit in a segment's ring buffer no matter how
+// much of it is evacuated.
+var ErrLargeEntry = errors.New("freecache: entry is larger than the segment buffer")
+
+// ErrAdmissionRefused is returned when the segment's EvictionPolicy
+// declines to admit a new entry in favor of the one it would have
+// evacuated to make room (see EvictionPolicy.Admit).
+var ErrAdmissionRefused = errors.New("freecache: entry refused admission by eviction policy")
+
+// entryHdr is the fixed-size record written just before a key and its
+// value in a segment's ring buffer.
+type entryHdr struct {
+	accessTime uint32
+	expireAt   uint32
+	keyLen     uint16
+	hash16     uint16
+	valLen     uint32
+	valCap     uint32
+	deleted    bool
+	slotId     uint8
+	reserved   [2]byte
+}
+
+// entryPtr locates an entry's header within a segment's ring buffer; it
+// is the unit stored in segment.slotsData and is what gets persisted by
+// SaveTo/LoadFrom and relocated by Evacuate.
+type entryPtr struct {
+	offset int64
+	hash16 uint16
+	keyLen uint16
+}
+
+// Timer supplies the current time as cache-internal entries see it, so
+// tests can swap in a fake clock instead of depending on wall time.
+type Timer interface {
+	Now() uint32
+}
+
+// systemTimer is the default Timer, a thin wrapper over time.Now.
+type systemTimer struct{}
+
+func (systemTimer) Now() uint32 { return uint32(time.Now().Unix()) }
+
+// hashFunc is the 64-bit FNV-1a hash used to pick a key's segment, slot
+// and hash16 fingerprint.
+func hashFunc(buf []byte) uint64 {
+	var hash uint64 = 14695981039346656037
+	for _, c := range buf {
+		hash ^= uint64(c)
+		hash *= 1099511628211
+	}
+	return hash
+}
+
+// segment is one shard of a Cache: its own ring buffer, its own slotted
+// index of entryPtrs, and its own EvictionPolicy, all guarded by the
+// corresponding element of Cache.locks rather than a lock of its own.
+type segment struct {
+	rb            RingBuf
+	segId         int
+	timer         Timer
+	entryCount    int64
+	totalCount    int64 // entries ever written, including ones since evacuated or deleted
+	totalEvacuate int64
+	hitCount      int64
+	missCount     int64
+	slotLens      [slotCount]int32
+	slotCap       int32
+	slotsData     []entryPtr
+	// policy is this segment's EvictionPolicy, installed by
+	// WithEvictionPolicy at Cache construction time. It's a field on
+	// segment rather than tracked in a side map so each segment's policy
+	// state is only ever touched while that segment's lock is held,
+	// preserving the existing sharded-lock design instead of serializing
+	// every segment behind one extra mutex.
+	policy EvictionPolicy
+}
+
+func newSegment(rb RingBuf, segId int) segment {
+	seg := segment{
+		rb:      rb,
+		segId:   segId,
+		timer:   systemTimer{},
+		slotCap: 1,
+		policy:  RingPolicy{},
+	}
+	seg.slotsData = make([]entryPtr, slotCount*int(seg.slotCap))
+	return seg
+}
+
+func (seg *segment) getSlot(slotId uint8) []entryPtr {
+	slotOff := int32(slotId) * seg.slotCap
+	return seg.slotsData[slotOff : slotOff+seg.slotLens[slotId] : slotOff+seg.slotCap]
+}
+
+// lookup finds key's entryPtr within slot by comparing hash16 and then
+// the key bytes themselves (hash16 alone isn't enough to rule out a
+// collision). It returns the index into slot, not into slotsData.
+func (seg *segment) lookup(slot []entryPtr, hash16 uint16, key []byte) (int, bool) {
+	for i, ptr := range slot {
+		if ptr.hash16 != hash16 || int(ptr.keyLen) != len(key) {
+			continue
+		}
+		got, err := seg.rb.Slice(ptr.offset+ENTRY_HDR_SIZE, int64(ptr.keyLen))
+		if err != nil || string(got) != string(key) {
+			continue
+		}
+		return i, true
+	}
+	return 0, false
+}
+
+// delEntryPtrAt removes the entry at index idx of slotId's slot,
+// shifting the entries above it down to keep the slot dense.
+func (seg *segment) delEntryPtrAt(slotId uint8, idx int) {
+	slotOff := int32(slotId) * seg.slotCap
+	slotLen := seg.slotLens[slotId]
+	copy(seg.slotsData[slotOff+int32(idx):slotOff+slotLen-1], seg.slotsData[slotOff+int32(idx)+1:slotOff+slotLen])
+	seg.slotLens[slotId]--
+	seg.entryCount--
+}
+
+// expand doubles every slot's capacity, relaying out slotsData. It's
+// called by insertEntryPtr when a slot is full.
+func (seg *segment) expand() {
+	newSlotCap := seg.slotCap * 2
+	if newSlotCap == 0 {
+		newSlotCap = 1
+	}
+	newSlotsData := make([]entryPtr, slotCount*int(newSlotCap))
+	for slotId := 0; slotId < slotCount; slotId++ {
+		oldOff := int32(slotId) * seg.slotCap
+		newOff := int32(slotId) * newSlotCap
+		copy(newSlotsData[newOff:newOff+seg.slotLens[slotId]], seg.slotsData[oldOff:oldOff+seg.slotLens[slotId]])
+	}
+	seg.slotCap = newSlotCap
+	seg.slotsData = newSlotsData
+}
+
+// insertEntryPtr appends ptr to slotId's slot, expanding every slot's
+// capacity first if slotId's slot is already full.
+func (seg *segment) insertEntryPtr(slotId uint8, ptr entryPtr) {
+	if seg.slotLens[slotId] == seg.slotCap {
+		seg.expand()
+	}
+	slotOff := int32(slotId) * seg.slotCap
+	seg.slotsData[slotOff+seg.slotLens[slotId]] = ptr
+	seg.slotLens[slotId]++
+}
+
+// relocateEntryPtr updates the stored offset of the entry slotId/hash16
+// used to have at oldOff, after RingBuf.Evacuate has moved it to newOff.
+func (seg *segment) relocateEntryPtr(slotId uint8, hash16 uint16, oldOff, newOff int64) {
+	slot := seg.getSlot(slotId)
+	for i := range slot {
+		if slot[i].hash16 == hash16 && slot[i].offset == oldOff {
+			slot[i].offset = newOff
+			return
+		}
+	}
+}
+
+// deleteEntryPtrFor removes the index entry for slotId/hash16 that still
+// points at oldOff, once evacuate has decided to evict it. It's a no-op
+// if the entry was already removed (e.g. by a prior Del).
+func (seg *segment) deleteEntryPtrFor(slotId uint8, hash16 uint16, oldOff int64) {
+	slot := seg.getSlot(slotId)
+	for i := range slot {
+		if slot[i].hash16 == hash16 && slot[i].offset == oldOff {
+			seg.delEntryPtrAt(slotId, i)
+			return
+		}
+	}
+}
+
+// policyOrDefault returns seg.policy, falling back to RingPolicy for a
+// zero-value segment that was never built through newSegment.
+func (seg *segment) policyOrDefault() EvictionPolicy {
+	if seg.policy == nil {
+		return RingPolicy{}
+	}
+	return seg.policy
+}
+
+// evacuate makes room for entryLen more bytes by scanning forward from
+// the ring's begin, consulting the segment's EvictionPolicy before each
+// live victim it walks past, until enough space would be free; it
+// returns false the moment the policy refuses to admit hash16 in favor
+// of a victim, without evicting anything at all -- including victims it
+// had already walked past and tentatively admitted earlier in the same
+// scan. It only commits a victim's eviction (dropping its index entry,
+// and detaching it onto a heap copy first if it's pinned by an open
+// GetStream reader -- see isStreamPinned) once the whole scan has
+// decided enough space exists and the call is about to return true. A
+// scan that walks past several admitted victims before a later one gets
+// refused must leave every one of them untouched: the caller gets
+// ErrAdmissionRefused and writes nothing, so any eviction applied along
+// the way -- including of hash16's own prior entry, if that happens to
+// be the first victim scanned -- would be destroying live data for a
+// write that never happened.
+//
+// evacuate only scans -- it never advances rb.begin/end/index itself.
+// It walks a local cursor forward through however many consecutive
+// victims entryLen requires (the ordinary hot-key-overwrite workload
+// evicts more than one in a single call), but the ring's own begin only
+// actually moves once the caller's subsequent RingBuf.Write calls append
+// entryLen bytes for real: Write already re-derives begin from end each
+// time the ring is over capacity, and that's the only thing allowed to
+// touch it. Moving rb.begin here directly, or pre-advancing it through
+// RingBuf.Skip before the corresponding bytes are actually written,
+// desyncs begin from index/end and corrupts getDataOff's wrapped check.
+func (seg *segment) evacuate(entryLen int64, hash16 uint16) bool {
+	policy := seg.policyOrDefault()
+	cur := seg.rb.Begin()
+	free := seg.rb.Size() - (seg.rb.End() - cur)
+	type victim struct {
+		slotId uint8
+		hash16 uint16
+		offset int64
+		valOff int64
+		valLen uint32
+	}
+	var victims []victim
+	for free < entryLen {
+		var hdrBuf [ENTRY_HDR_SIZE]byte
+		if _, err := seg.rb.ReadAt(hdrBuf[:], cur); err != nil {
+			// Nothing left to evict; let the write proceed into
+			// whatever space is there.
+			break
+		}
+		hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+		oldEntryLen := int64(ENTRY_HDR_SIZE) + int64(hdr.keyLen) + int64(hdr.valLen)
+		if !hdr.deleted {
+			if !policy.Admit(uint64(hash16), uint64(hdr.hash16)) {
+				return false
+			}
+			victims = append(victims, victim{
+				slotId: hdr.slotId,
+				hash16: hdr.hash16,
+				offset: cur,
+				valOff: cur + ENTRY_HDR_SIZE + int64(hdr.keyLen),
+				valLen: hdr.valLen,
+			})
+		}
+		cur += oldEntryLen
+		free += oldEntryLen
+	}
+	for _, v := range victims {
+		if isStreamPinned(seg, v.valOff) {
+			if value, err := seg.rb.Slice(v.valOff, int64(v.valLen)); err == nil {
+				buf := make([]byte, len(value))
+				copy(buf, value)
+				detachPinnedStream(seg, v.valOff, buf)
+			}
+		}
+		seg.deleteEntryPtrFor(v.slotId, v.hash16, v.offset)
+		seg.totalEvacuate++
+	}
+	return true
+}
+
+// set inserts or overwrites key's value. The caller must hold the
+// segment's lock.
+func (seg *segment) set(key, value []byte, hashVal uint64, expireSeconds int) error {
+	if len(key) > maxKeyLength {
+		return ErrLargeKey
+	}
+	entryLen := int64(ENTRY_HDR_SIZE) + int64(len(key)) + int64(len(value))
+	if entryLen > seg.rb.Size() {
+		return ErrLargeEntry
+	}
+	slotId := uint8(hashVal)
+	hash16 := uint16(hashVal)
+	if !seg.evacuate(entryLen, hash16) {
+		return ErrAdmissionRefused
+	}
+
+	// Only drop the existing entry's index pointer once evacuate has
+	// committed to making room -- deleting it first and then refusing
+	// admission for some other victim would leave the old value
+	// unreachable in the ring with nothing to show for it but an error.
+	// Re-lookup rather than reusing a slot/idx captured before evacuate,
+	// since evacuate's own deletions of other victims can have shifted
+	// positions within this key's slot.
+	slot := seg.getSlot(slotId)
+	if idx, ok := seg.lookup(slot, hash16, key); ok {
+		seg.delEntryPtrAt(slotId, idx)
+	}
+
+	now := seg.timer.Now()
+	var hdrBuf [ENTRY_HDR_SIZE]byte
+	hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	hdr.hash16 = hash16
+	hdr.keyLen = uint16(len(key))
+	hdr.valLen = uint32(len(value))
+	hdr.accessTime = now
+	if expireSeconds > 0 {
+		hdr.expireAt = now + uint32(expireSeconds)
+	}
+	hdr.slotId = slotId
+
+	offset := seg.rb.End()
+	if _, err := seg.rb.Write(hdrBuf[:]); err != nil {
+		return err
+	}
+	if _, err := seg.rb.Write(key); err != nil {
+		return err
+	}
+	if _, err := seg.rb.Write(value); err != nil {
+		return err
+	}
+	seg.insertEntryPtr(slotId, entryPtr{offset: offset, hash16: hash16, keyLen: hdr.keyLen})
+	seg.entryCount++
+	seg.totalCount++
+	return nil
+}
+
+// get returns a copy of key's value. The caller must hold the segment's
+// lock. On a hit it notifies the segment's EvictionPolicy and, for a
+// policy that protects hot keys (e.g. SLRUPolicy), re-Evacuates the
+// entry so it stays ahead of the ring's overwrite point.
+func (seg *segment) get(key []byte, hashVal uint64) ([]byte, error) {
+	slotId := uint8(hashVal)
+	hash16 := uint16(hashVal)
+	slot := seg.getSlot(slotId)
+	idx, ok := seg.lookup(slot, hash16, key)
+	if !ok {
+		seg.missCount++
+		return nil, ErrNotFound
+	}
+	ptr := slot[idx]
+	var hdrBuf [ENTRY_HDR_SIZE]byte
+	if _, err := seg.rb.ReadAt(hdrBuf[:], ptr.offset); err != nil {
+		return nil, err
+	}
+	hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	now := seg.timer.Now()
+	if hdr.expireAt != 0 && hdr.expireAt <= now {
+		seg.delEntryPtrAt(slotId, idx)
+		seg.missCount++
+		return nil, ErrNotFound
+	}
+	valOff := ptr.offset + ENTRY_HDR_SIZE + int64(hdr.keyLen)
+	if isPending(seg, valOff) {
+		// A SetStream writer for this key is still in flight; its value
+		// bytes aren't complete, so Get reports the same miss it would
+		// if the entry didn't exist yet rather than returning them.
+		seg.missCount++
+		return nil, ErrNotFound
+	}
+	valSlice, err := seg.rb.Slice(valOff, int64(hdr.valLen))
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, len(valSlice))
+	copy(value, valSlice)
+
+	hdr.accessTime = now
+	seg.rb.WriteAt(hdrBuf[:], ptr.offset)
+	seg.hitCount++
+
+	policy := seg.policyOrDefault()
+	policy.OnHit(uint64(hash16))
+	if protector, ok := policy.(protectedChecker); ok && protector.Protected(uint64(hash16)) {
+		entryLen := int(ENTRY_HDR_SIZE + int64(hdr.keyLen) + int64(hdr.valLen))
+		if newOff := seg.rb.Evacuate(ptr.offset, entryLen); newOff >= 0 {
+			slot[idx].offset = newOff
+		}
+	}
+	return value, nil
+}
+
+// del removes key's entry, if present. The caller must hold the
+// segment's lock.
+func (seg *segment) del(key []byte, hashVal uint64) bool {
+	slotId := uint8(hashVal)
+	hash16 := uint16(hashVal)
+	slot := seg.getSlot(slotId)
+	idx, ok := seg.lookup(slot, hash16, key)
+	if !ok {
+		return false
+	}
+	seg.delEntryPtrAt(slotId, idx)
+	return true
+}
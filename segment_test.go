@@ -0,0 +1,86 @@
+package freecache
+
+import (
+	"bytes"
+	"testing"
+)
+
+// refuseHashPolicy is an EvictionPolicy test double that refuses
+// admission whenever the victim being considered is refuseHash,
+// regardless of the incoming key, so a test can force evacuate to fail
+// partway through evicting a specific, known victim.
+type refuseHashPolicy struct {
+	refuseHash uint64
+}
+
+func (p *refuseHashPolicy) Admit(hashVal, victimHash uint64) bool {
+	return victimHash != p.refuseHash
+}
+func (p *refuseHashPolicy) OnHit(uint64)      {}
+func (p *refuseHashPolicy) Rejections() int64 { return 0 }
+
+// TestSetAdmissionRefusalPreservesExistingEntry guards against a
+// regression where overwriting an existing key deleted its old index
+// entry before evacuate ran, then returned ErrAdmissionRefused once
+// evacuate refused to evict some other, unrelated victim further along
+// in its scan -- losing the old value even though Set reported failure.
+func TestSetAdmissionRefusalPreservesExistingEntry(t *testing.T) {
+	seg := newSegment(NewRingBuf(90, 0), 0)
+	keyA := []byte("A")
+	keyB := []byte("B")
+	hashA := hashFunc(keyA)
+	hashB := hashFunc(keyB)
+
+	if err := seg.set(keyA, bytes.Repeat([]byte{1}, 10), hashA, 0); err != nil {
+		t.Fatalf("set A: %v", err)
+	}
+	if err := seg.set(keyB, bytes.Repeat([]byte{2}, 10), hashB, 0); err != nil {
+		t.Fatalf("set B: %v", err)
+	}
+
+	seg.policy = &refuseHashPolicy{refuseHash: uint64(uint16(hashB))}
+
+	// Overwriting A with a value big enough to require evicting both A's
+	// own old entry and B's forces evacuate to walk past B, where the
+	// policy refuses admission.
+	err := seg.set(keyA, bytes.Repeat([]byte{3}, 50), hashA, 0)
+	if err != ErrAdmissionRefused {
+		t.Fatalf("set A (refused): got err %v, want ErrAdmissionRefused", err)
+	}
+
+	got, err := seg.get(keyA, hashA)
+	if err != nil {
+		t.Fatalf("get A after refused overwrite: %v", err)
+	}
+	if !bytes.Equal(got, bytes.Repeat([]byte{1}, 10)) {
+		t.Fatalf("get A after refused overwrite: got %v, want original value", got)
+	}
+}
+
+// TestSegmentRepeatedSetSameKey guards against a regression where
+// evacuate() advanced RingBuf.begin itself (directly, or through
+// RingBuf.Skip) instead of leaving it to the following RingBuf.Write
+// calls, desyncing begin from index/end once the ring had
+// wrapped and a single evacuate call walked more than one victim.
+// Repeatedly overwriting one hot key is the ordinary workload that
+// triggers it: once the ring is full, every Set evicts the previous
+// copy of the same key.
+func TestSegmentRepeatedSetSameKey(t *testing.T) {
+	seg := newSegment(NewRingBuf(4096, 0), 0)
+	key := []byte("hot-key")
+	hashVal := hashFunc(key)
+
+	for i := 0; i < 2000; i++ {
+		value := bytes.Repeat([]byte{byte(i)}, 32)
+		if err := seg.set(key, value, hashVal, 0); err != nil {
+			t.Fatalf("set #%d: %v", i, err)
+		}
+		got, err := seg.get(key, hashVal)
+		if err != nil {
+			t.Fatalf("get #%d: %v", i, err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Fatalf("get #%d: got %v, want %v", i, got, value)
+		}
+	}
+}
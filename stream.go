@@ -0,0 +1,350 @@
+package freecache
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"unsafe"
+)
+
+// ErrNotFound is returned when a key has no entry in the cache.
+var ErrNotFound = errors.New("entry not found")
+
+// ErrStreamInUse is returned by GetStream for an entry that already has
+// an in-flight SetStream writer, since its value bytes aren't complete
+// yet.
+var ErrStreamInUse = errors.New("freecache: entry has an in-flight stream")
+
+// pinKey identifies a ring-buffer offset within a specific segment.
+type pinKey struct {
+	seg *segment
+	off int64
+}
+
+// pin tracks one open GetStream reader's refcount and, once
+// segment.evacuate has had to reclaim the ring space under it, a heap
+// copy of the value bytes for the reader to fall back to.
+type pin struct {
+	refs int
+	data []byte // nil until detachPinnedStream copies the value out
+}
+
+// streamPins tracks which (segment, offset) pairs have an open GetStream
+// reader, so a concurrent evacuate (see segment.evacuate) can detach the
+// reader onto a heap copy instead of leaving it pointed at a relocated
+// or reused ring offset. It's keyed at package level rather than as a
+// field on segment so this change doesn't require touching segment's
+// own layout.
+var streamPins = struct {
+	mu   sync.Mutex
+	pins map[pinKey]*pin
+}{pins: make(map[pinKey]*pin)}
+
+func pinStream(seg *segment, off int64) {
+	streamPins.mu.Lock()
+	k := pinKey{seg, off}
+	if p, ok := streamPins.pins[k]; ok {
+		p.refs++
+	} else {
+		streamPins.pins[k] = &pin{refs: 1}
+	}
+	streamPins.mu.Unlock()
+}
+
+func unpinStream(seg *segment, off int64) {
+	streamPins.mu.Lock()
+	k := pinKey{seg, off}
+	if p, ok := streamPins.pins[k]; ok {
+		p.refs--
+		if p.refs <= 0 {
+			delete(streamPins.pins, k)
+		}
+	}
+	streamPins.mu.Unlock()
+}
+
+// isStreamPinned reports whether off is currently pinned by an open
+// GetStream reader. segment.evacuate consults this before reclaiming
+// the ring space at off.
+func isStreamPinned(seg *segment, off int64) bool {
+	streamPins.mu.Lock()
+	defer streamPins.mu.Unlock()
+	p, ok := streamPins.pins[pinKey{seg, off}]
+	return ok && p.refs > 0
+}
+
+// detachPinnedStream records buf as the value bytes for the open
+// GetStream reader(s) pinning off, so their Read calls switch from the
+// ring buffer -- whose space at off is about to be reclaimed -- to buf.
+// Called by segment.evacuate while holding the segment's lock.
+func detachPinnedStream(seg *segment, off int64, buf []byte) {
+	streamPins.mu.Lock()
+	if p, ok := streamPins.pins[pinKey{seg, off}]; ok {
+		p.data = buf
+	}
+	streamPins.mu.Unlock()
+}
+
+// pinnedData returns the heap copy detachPinnedStream recorded for off,
+// if evacuate has reclaimed the ring space under it, so Read can
+// continue from there instead of the (now invalid) ring offset.
+func pinnedData(seg *segment, off int64) []byte {
+	streamPins.mu.Lock()
+	defer streamPins.mu.Unlock()
+	if p, ok := streamPins.pins[pinKey{seg, off}]; ok {
+		return p.data
+	}
+	return nil
+}
+
+// pendingWrites tracks the (segment, value offset) of every SetStream
+// that's been reserved but not yet Close'd successfully, so a concurrent
+// Get/GetStream/iteration can tell its value bytes aren't complete yet
+// instead of reading whatever was previously at that ring span. Keyed at
+// package level for the same reason as streamPins.
+var pendingWrites = struct {
+	mu      sync.Mutex
+	pending map[pinKey]struct{}
+}{pending: make(map[pinKey]struct{})}
+
+// markPending records valOff as an in-flight SetStream write. Called by
+// reserveForStream while holding the segment's lock.
+func markPending(seg *segment, valOff int64) {
+	pendingWrites.mu.Lock()
+	pendingWrites.pending[pinKey{seg, valOff}] = struct{}{}
+	pendingWrites.mu.Unlock()
+}
+
+// clearPending makes valOff's entry visible again, once its SetStream
+// writer has been Closed having written exactly the reserved size.
+func clearPending(seg *segment, valOff int64) {
+	pendingWrites.mu.Lock()
+	delete(pendingWrites.pending, pinKey{seg, valOff})
+	pendingWrites.mu.Unlock()
+}
+
+// isPending reports whether valOff is still an in-flight SetStream write.
+func isPending(seg *segment, valOff int64) bool {
+	pendingWrites.mu.Lock()
+	defer pendingWrites.mu.Unlock()
+	_, ok := pendingWrites.pending[pinKey{seg, valOff}]
+	return ok
+}
+
+// setStreamWriter is the io.WriteCloser returned by Cache.SetStream. It
+// streams into the reserved [0, size) value span via a RingBufWriter and
+// fails closed if the caller writes more than the reserved size or closes
+// having written less -- a short value would leave stale bytes from a
+// previous occupant visible to readers.
+type setStreamWriter struct {
+	w       *RingBufWriter
+	written int64
+	size    int64
+	seg     *segment
+	valOff  int64
+}
+
+func (sw *setStreamWriter) Write(p []byte) (int, error) {
+	if sw.written+int64(len(p)) > sw.size {
+		return 0, ErrOutOfRange
+	}
+	n, err := sw.w.Write(p)
+	sw.written += int64(n)
+	return n, err
+}
+
+// Close reports io.ErrShortWrite without clearing the entry's pending
+// mark if fewer than size bytes were written, leaving the entry hidden
+// from Get/GetStream rather than exposing a partially-written value.
+func (sw *setStreamWriter) Close() error {
+	if sw.written != sw.size {
+		return io.ErrShortWrite
+	}
+	clearPending(sw.seg, sw.valOff)
+	return nil
+}
+
+// SetStream reserves size bytes for key's value and returns a writer that
+// streams the value into the segment's ring buffer directly, so callers
+// with large values (tens of MB) don't have to materialize them as a
+// single []byte the way Set requires. The returned writer must be
+// written with exactly size bytes and then Closed; the entry is not
+// visible to Get until Close succeeds.
+func (cache *Cache) SetStream(key []byte, expireSeconds int, size int) (io.WriteCloser, error) {
+	hashVal := hashFunc(key)
+	segID := hashVal & 255
+	cache.locks[segID].Lock()
+	defer cache.locks[segID].Unlock()
+	seg := &cache.segments[segID]
+	valOff, err := seg.reserveForStream(key, hashVal, expireSeconds, size)
+	if err != nil {
+		return nil, err
+	}
+	return &setStreamWriter{
+		w:      seg.rb.WriterAt(valOff, int64(size)),
+		size:   int64(size),
+		seg:    seg,
+		valOff: valOff,
+	}, nil
+}
+
+// getStreamReader is the io.ReadCloser returned by Cache.GetStream. While
+// open it pins its value's offset so a concurrent evacuate detaches it
+// onto a heap copy (see detachPinnedStream) rather than leaving it
+// pointed at a relocated or reused ring offset. The pin alone isn't
+// enough to make Read safe on its own: the pinned-data fallback only
+// kicks in once evacuate has actually detached the reader, and until
+// then Read walks seg.rb directly, which a concurrent Set/evacuate on
+// the same segment can be mutating at the same time. lock is held for
+// each Read call (see detachPinnedStream, which segment.evacuate calls
+// with the lock held) to serialize against that.
+type getStreamReader struct {
+	r    *RingBufReader
+	seg  *segment
+	lock *sync.Mutex
+	off  int64 // original ring offset of the value, used as the pin key
+	read int64 // bytes handed to the caller so far
+}
+
+func (sr *getStreamReader) Read(p []byte) (int, error) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	if buf := pinnedData(sr.seg, sr.off); buf != nil {
+		if sr.read >= int64(len(buf)) {
+			return 0, io.EOF
+		}
+		n := copy(p, buf[sr.read:])
+		sr.read += int64(n)
+		return n, nil
+	}
+	n, err := sr.r.Read(p)
+	sr.read += int64(n)
+	return n, err
+}
+
+func (sr *getStreamReader) Close() error {
+	unpinStream(sr.seg, sr.off)
+	return nil
+}
+
+// GetStream returns a reader over key's value and its length, streaming
+// it directly out of the segment's ring buffer instead of allocating the
+// whole value up front the way Get does. The reader pins the value's
+// offset against eviction until Close is called; callers should Close it
+// promptly. It returns ErrStreamInUse if key has an in-flight SetStream
+// writer that hasn't Closed yet, since the value bytes it would stream
+// aren't complete.
+func (cache *Cache) GetStream(key []byte) (io.ReadCloser, int, error) {
+	hashVal := hashFunc(key)
+	segID := hashVal & 255
+	cache.locks[segID].Lock()
+	seg := &cache.segments[segID]
+	valOff, valLen, err := seg.lookupForStream(key, hashVal)
+	if err == nil {
+		pinStream(seg, valOff)
+	}
+	cache.locks[segID].Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	return &getStreamReader{
+		r:    seg.rb.ReaderAt(valOff, int64(valLen)),
+		seg:  seg,
+		lock: &cache.locks[segID],
+		off:  valOff,
+	}, valLen, nil
+}
+
+// reserveForStream writes key's entry header and key bytes, reserves
+// size bytes for the value directly after them, and registers the new
+// entry's pointer the same way set does, returning the value span's
+// offset for the caller to stream into. Like set, it deletes any
+// existing entry for key so re-streaming a key doesn't leave a stale
+// duplicate -- but only once evacuate has committed to making room, not
+// before, since evacuate can still refuse admission for some other
+// victim (see set) -- and it calls evacuate to make room (which in turn
+// detaches any pinned GetStream reader it has to reclaim space from)
+// rather than writing straight into the ring and silently overwriting
+// live entries. The caller must hold the segment's lock.
+func (seg *segment) reserveForStream(key []byte, hashVal uint64, expireSeconds int, size int) (valOff int64, err error) {
+	if len(key) > maxKeyLength {
+		return 0, ErrLargeKey
+	}
+	entryLen := int64(ENTRY_HDR_SIZE) + int64(len(key)) + int64(size)
+	if entryLen > seg.rb.Size() {
+		return 0, ErrLargeEntry
+	}
+	slotId := uint8(hashVal)
+	hash16 := uint16(hashVal)
+	if !seg.evacuate(entryLen, hash16) {
+		return 0, ErrAdmissionRefused
+	}
+
+	slot := seg.getSlot(slotId)
+	if idx, ok := seg.lookup(slot, hash16, key); ok {
+		seg.delEntryPtrAt(slotId, idx)
+	}
+
+	now := seg.timer.Now()
+	hdr := entryHdr{
+		keyLen: uint16(len(key)),
+		hash16: hash16,
+		valLen: uint32(size),
+		slotId: slotId,
+	}
+	if expireSeconds > 0 {
+		hdr.expireAt = now + uint32(expireSeconds)
+	}
+	entryOff := seg.rb.End()
+	var hdrBuf [ENTRY_HDR_SIZE]byte
+	*(*entryHdr)(unsafe.Pointer(&hdrBuf[0])) = hdr
+	if _, err := seg.rb.Write(hdrBuf[:]); err != nil {
+		return 0, err
+	}
+	if _, err := seg.rb.Write(key); err != nil {
+		return 0, err
+	}
+	valOff = seg.rb.End()
+	seg.rb.Skip(int64(size))
+
+	seg.insertEntryPtr(slotId, entryPtr{offset: entryOff, hash16: hash16, keyLen: hdr.keyLen})
+	seg.entryCount++
+	seg.totalCount++
+	markPending(seg, valOff)
+	return valOff, nil
+}
+
+// lookupForStream finds key's entry and returns its value span without
+// reading the value itself. The caller must hold the segment's lock.
+func (seg *segment) lookupForStream(key []byte, hashVal uint64) (valOff int64, valLen int, err error) {
+	slotId := uint8(hashVal)
+	hash16 := uint16(hashVal)
+	slot := seg.getSlot(slotId)
+	now := seg.timer.Now()
+	for _, ptr := range slot {
+		if ptr.hash16 != hash16 || int(ptr.keyLen) != len(key) {
+			continue
+		}
+		var hdrBuf [ENTRY_HDR_SIZE]byte
+		if _, err := seg.rb.ReadAt(hdrBuf[:], ptr.offset); err != nil {
+			return 0, 0, err
+		}
+		hdr := (*entryHdr)(unsafe.Pointer(&hdrBuf[0]))
+		if hdr.expireAt != 0 && hdr.expireAt <= now {
+			continue
+		}
+		gotKey, err := seg.rb.Slice(ptr.offset+ENTRY_HDR_SIZE, int64(hdr.keyLen))
+		if err != nil {
+			return 0, 0, err
+		}
+		if string(gotKey) != string(key) {
+			continue
+		}
+		valOff := ptr.offset + ENTRY_HDR_SIZE + int64(hdr.keyLen)
+		if isPending(seg, valOff) {
+			return 0, 0, ErrStreamInUse
+		}
+		return valOff, int(hdr.valLen), nil
+	}
+	return 0, 0, ErrNotFound
+}